@@ -0,0 +1,69 @@
+// Package nixbuilder defines the wire types and gRPC service used to
+// offload a nix build to a NixBuilder daemon; see nixbuilder.proto for
+// the schema these mirror.
+//
+// These are plain, hand-maintained Go structs, not protoc-gen-go output:
+// they're marshaled by nixBuilderCodec (pkg/nix/builder_codec.go), a JSON
+// codec registered specifically for this service instead of gRPC's
+// default "proto" codec, so they don't need to implement
+// proto.Message/ProtoReflect.
+package nixbuilder
+
+type BuildImageRequest struct {
+	// Id uniquely identifies the build so that it can later be cancelled.
+	Id string `json:"id,omitempty"`
+
+	// Ref is the nix: image reference being built.
+	Ref string `json:"ref,omitempty"`
+
+	// System is the nix system double (e.g. x86_64-linux) to build for.
+	System string `json:"system,omitempty"`
+
+	// OutputArchivePath is where the caller wants the resulting nix image
+	// archive written, on the caller's own filesystem. The builder daemon
+	// never writes to this path directly, even when colocated: it builds
+	// to a path of its own choosing and streams the archive back as
+	// BuildImageProgress.ArchiveChunk, so callers never have to assume
+	// shared storage with the builder.
+	OutputArchivePath string `json:"outputArchivePath,omitempty"`
+
+	// Credentials carries registry and flake host auth, forwarded from
+	// the CRI PullImage request that triggered this build.
+	Credentials *BuildCredentials `json:"credentials,omitempty"`
+}
+
+type BuildCredentials struct {
+	Registries      map[string]*RegistryAuth `json:"registries,omitempty"`
+	FlakeHostTokens map[string]string        `json:"flakeHostTokens,omitempty"`
+}
+
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identityToken,omitempty"`
+}
+
+type BuildImageProgress struct {
+	// Progress is a human readable description of the current build step.
+	Progress string `json:"progress,omitempty"`
+
+	// Stderr carries a chunk of the underlying `nix build` process's
+	// stderr, as it's produced.
+	Stderr []byte `json:"stderr,omitempty"`
+
+	// Digest is only set on the final message, once the full archive has
+	// been streamed back via ArchiveChunk and written to
+	// OutputArchivePath: the sha256 content digest of the archive.
+	Digest string `json:"digest,omitempty"`
+
+	// ArchiveChunk carries a piece of the built archive's bytes, in
+	// order, across one or more messages once the build itself has
+	// finished. It is unset on messages that only carry Progress/Stderr.
+	ArchiveChunk []byte `json:"archiveChunk,omitempty"`
+}
+
+type CancelBuildRequest struct {
+	Id string `json:"id,omitempty"`
+}
+
+type CancelBuildResponse struct{}
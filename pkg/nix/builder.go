@@ -0,0 +1,175 @@
+package nix
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	nixbuilder "github.com/pdtpartners/nix-snapshotter/api/services/nixbuilder/v1"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+)
+
+// NixBuilder builds the nix image archive for ref, for the given nix
+// system double, and writes it to archivePath. imageService invokes it for
+// every PullImage request whose archive isn't already on disk, forwarding
+// whatever registry or flake host credentials the CRI PullImage request
+// carried so that private flakes and private registries resolve the same
+// way they would for a plain `nix build` on an authenticated host.
+//
+// The default implementation runs nix2container.Build on the local host.
+// grpcNixBuilder instead forwards the same call to a NixBuilder gRPC
+// server, either a colocated daemon on a local Unix socket (BuilderServer
+// served on ListenLocal) or a remote build farm reached over TCP/mTLS, so that
+// the (potentially heavy) Nix build doesn't have to happen on the node
+// handling kubelet requests.
+type NixBuilder interface {
+	BuildImage(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error
+}
+
+// nixBuilderFunc adapts a plain function to NixBuilder.
+type nixBuilderFunc func(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error
+
+func (f nixBuilderFunc) BuildImage(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error {
+	return f(ctx, ref, system, archivePath, creds)
+}
+
+// buildEnvMu serializes every local build's credential staging against
+// every other one. nix2container.Build has no parameter to hand
+// credentials to directly (see stageCredentials), so they're staged as
+// process-wide DOCKER_CONFIG/NIX_CONFIG env vars instead — and since
+// is.sf (image_service.go) only dedupes concurrent builds of the *same*
+// archivePath, two goroutines building two different private images
+// would otherwise race to set/restore that shared state, each
+// potentially building with the other's credentials or having its own
+// yanked out from under it mid-build. Holding buildEnvMu for the whole
+// stage-build-restore cycle trades away running local builds concurrently
+// for correctness, which is the only thing this package controls without
+// changing nix2container.Build's signature.
+var buildEnvMu sync.Mutex
+
+// defaultNixBuilder runs `nix build` directly on the local host.
+var defaultNixBuilder NixBuilder = nixBuilderFunc(func(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error {
+	log.G(ctx).WithField("ref", ref).Debug("[nix-builder] Building nix image archive locally")
+
+	buildEnvMu.Lock()
+	defer buildEnvMu.Unlock()
+
+	cleanup, env, err := stageCredentials(creds)
+	if err != nil {
+		return fmt.Errorf("failed to stage nix build credentials: %w", err)
+	}
+	defer cleanup()
+
+	// nix2container.Build shells out to `nix build`, which picks up
+	// DOCKER_CONFIG/NIX_CONFIG from its own environment, so the staged
+	// credentials are threaded through via the process environment rather
+	// than a parameter, keeping this call compatible with
+	// nix2container.Build's existing (ctx, ref, archivePath) signature.
+	restoreEnv := setEnv(env)
+	defer restoreEnv()
+
+	return nix2container.Build(ctx, ref, archivePath)
+})
+
+// setEnv sets each key/value in env as a process environment variable and
+// returns a func that restores whatever was previously set (or unsets it,
+// if it was previously unset). It is always safe to call the returned
+// func, including when env is empty.
+func setEnv(env map[string]string) func() {
+	type saved struct {
+		value string
+		had   bool
+	}
+	prev := make(map[string]saved, len(env))
+	for k, v := range env {
+		value, had := os.LookupEnv(k)
+		prev[k] = saved{value: value, had: had}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, s := range prev {
+			if s.had {
+				os.Setenv(k, s.value)
+			} else {
+				os.Unsetenv(k)
+			}
+		}
+	}
+}
+
+// dockerConfig is the subset of ~/.docker/config.json that `nix build`'s
+// registry fetchers read to authenticate against a private OCI registry.
+type dockerConfig struct {
+	Auths map[string]dockerAuthEntry `json:"auths"`
+}
+
+type dockerAuthEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// stageCredentials writes creds out as a temporary ~/.docker/config.json
+// and a NIX_CONFIG access-tokens line, returning the environment variables
+// the child `nix build` process needs to pick them up and a cleanup func
+// that removes whatever was staged. It is always safe to call cleanup,
+// including when creds is nil.
+func stageCredentials(creds *nixbuilder.BuildCredentials) (func(), map[string]string, error) {
+	noop := func() {}
+	if creds == nil {
+		return noop, nil, nil
+	}
+
+	env := map[string]string{}
+	var dir string
+	cleanup := func() {
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}
+
+	if len(creds.Registries) > 0 {
+		cfg := dockerConfig{Auths: make(map[string]dockerAuthEntry, len(creds.Registries))}
+		for registry, auth := range creds.Registries {
+			entry := dockerAuthEntry{IdentityToken: auth.IdentityToken}
+			if auth.Username != "" || auth.Password != "" {
+				entry.Auth = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+			}
+			cfg.Auths[registry] = entry
+		}
+
+		var err error
+		dir, err = os.MkdirTemp("", "nix-snapshotter-docker-config-*")
+		if err != nil {
+			return noop, nil, err
+		}
+
+		data, err := json.Marshal(cfg)
+		if err != nil {
+			cleanup()
+			return noop, nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0o600); err != nil {
+			cleanup()
+			return noop, nil, err
+		}
+		env["DOCKER_CONFIG"] = dir
+	}
+
+	if len(creds.FlakeHostTokens) > 0 {
+		tokens := make([]string, 0, len(creds.FlakeHostTokens))
+		for host, token := range creds.FlakeHostTokens {
+			tokens = append(tokens, host+"="+token)
+		}
+		sort.Strings(tokens)
+		env["NIX_CONFIG"] = "access-tokens = " + strings.Join(tokens, " ")
+	}
+
+	return cleanup, env, nil
+}
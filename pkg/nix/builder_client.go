@@ -0,0 +1,115 @@
+package nix
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/containerd/containerd/log"
+	nixbuilder "github.com/pdtpartners/nix-snapshotter/api/services/nixbuilder/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// grpcNixBuilder is a NixBuilder that forwards BuildImage calls to a
+// NixBuilder gRPC server, whether that's the local Unix-socket daemon or a
+// remote TCP/mTLS build farm.
+type grpcNixBuilder struct {
+	client nixbuilder.NixBuilderClient
+}
+
+// DialBuilder connects to a NixBuilder gRPC server at addr. A nil
+// tlsConfig dials addr as a plaintext Unix socket, e.g.
+// "unix:///run/nix-snapshotter/builder.sock", the default colocated
+// builder daemon. A non-nil tlsConfig dials addr over TCP/mTLS, for a
+// remote build farm.
+func DialBuilder(ctx context.Context, addr string, tlsConfig *tls.Config) (NixBuilder, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(nixBuilderCodec{})),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial nix builder at %s: %w", addr, err)
+	}
+	return &grpcNixBuilder{client: nixbuilder.NewNixBuilderClient(conn)}, nil
+}
+
+// BuildImage implements NixBuilder by streaming the build to a remote
+// NixBuilder server, relaying its progress through containerd's logger,
+// and writing the archive bytes it streams back to archivePath. The
+// server never shares a filesystem with us (it may be a genuinely remote
+// build farm), so archivePath is only ever written here, from the
+// ArchiveChunk bytes the server sends, never assumed to already exist on
+// the server's side. It aborts the remote build if ctx is cancelled
+// before the stream finishes.
+func (b *grpcNixBuilder) BuildImage(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error {
+	id := fmt.Sprintf("%s@%s", ref, system)
+	stream, err := b.client.BuildImage(ctx, &nixbuilder.BuildImageRequest{
+		Id:                id,
+		Ref:               ref,
+		System:            system,
+		OutputArchivePath: archivePath,
+		Credentials:       creds,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start remote nix build: %w", err)
+	}
+
+	tmpPath := archivePath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmpPath, err)
+	}
+	defer tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	for {
+		progress, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				if _, cancelErr := b.client.CancelBuild(context.Background(), &nixbuilder.CancelBuildRequest{Id: id}); cancelErr != nil {
+					log.G(ctx).WithError(cancelErr).Warn("[nix-builder] Failed to cancel remote build")
+				}
+			}
+			return fmt.Errorf("remote nix build failed: %w", err)
+		}
+		if progress.Progress != "" {
+			log.G(ctx).Infof("[nix-builder] %s", progress.Progress)
+		}
+		if len(progress.Stderr) > 0 {
+			log.G(ctx).Infof("[nix-builder] %s", progress.Stderr)
+		}
+		if len(progress.ArchiveChunk) > 0 {
+			if _, err := tmpFile.Write(progress.ArchiveChunk); err != nil {
+				return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+			}
+		}
+		if progress.Digest != "" {
+			if err := tmpFile.Close(); err != nil {
+				return fmt.Errorf("failed to finish writing %s: %w", tmpPath, err)
+			}
+			gotDigest, err := fileDigest(tmpPath)
+			if err != nil {
+				return fmt.Errorf("failed to digest %s: %w", tmpPath, err)
+			}
+			if gotDigest != progress.Digest {
+				return fmt.Errorf("remote nix build archive digest mismatch: got %s, want %s", gotDigest, progress.Digest)
+			}
+			if err := os.Rename(tmpPath, archivePath); err != nil {
+				return fmt.Errorf("failed to finalize %s: %w", archivePath, err)
+			}
+			log.G(ctx).WithField("digest", progress.Digest).Debug("[nix-builder] Remote build finished")
+		}
+	}
+}
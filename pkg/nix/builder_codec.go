@@ -0,0 +1,25 @@
+package nix
+
+import "encoding/json"
+
+// nixBuilderCodec is a grpc/encoding.Codec for the NixBuilder service.
+// api/services/nixbuilder/v1's message types are hand-maintained structs,
+// not protoc-gen-go output, so they don't implement
+// proto.Message/ProtoReflect and can't go through gRPC's default "proto"
+// codec. This codec marshals them as JSON instead, which only needs
+// ordinary struct tags. DialBuilder and NewGRPCServer both force it, so
+// it never affects any other gRPC traffic (e.g. containerd's own client)
+// in the same process.
+type nixBuilderCodec struct{}
+
+func (nixBuilderCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (nixBuilderCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (nixBuilderCodec) Name() string {
+	return "nixbuilder-json"
+}
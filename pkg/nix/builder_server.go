@@ -0,0 +1,175 @@
+package nix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	nixbuilder "github.com/pdtpartners/nix-snapshotter/api/services/nixbuilder/v1"
+	"google.golang.org/grpc"
+)
+
+// NewGRPCServer returns a *grpc.Server configured to serve the NixBuilder
+// service, forcing nixBuilderCodec instead of gRPC's default "proto"
+// codec so that nixbuilder.v1's hand-maintained message types don't need
+// to implement proto.Message. Scoping the codec to opts here, rather than
+// registering it globally, means it only applies to connections served by
+// this *grpc.Server and never affects any other gRPC server (e.g.
+// containerd's) in the same process.
+func NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ForceServerCodec(nixBuilderCodec{}))
+	return grpc.NewServer(opts...)
+}
+
+// BuilderServer exposes a NixBuilder over gRPC. The same server type backs
+// both the default, colocated builder daemon reached over a Unix socket
+// and a remote build farm reached over TCP/mTLS; only the listener and
+// transport credentials differ.
+type BuilderServer struct {
+	nixbuilder.UnimplementedNixBuilderServer
+
+	builder NixBuilder
+
+	mu      sync.Mutex
+	cancels map[string]context.CancelFunc
+}
+
+// NewBuilderServer returns a BuilderServer that runs builds through
+// builder. Pair it with ListenLocal or a TCP/mTLS listener and
+// NewGRPCServer to actually serve it; nothing in this tree does that yet
+// (there is no cmd package here to start a daemon from), so these are
+// library entry points for whatever does, not something reachable from a
+// running nix-snapshotter binary today.
+func NewBuilderServer(builder NixBuilder) *BuilderServer {
+	return &BuilderServer{
+		builder: builder,
+		cancels: make(map[string]context.CancelFunc),
+	}
+}
+
+// ListenLocal opens the Unix socket used by the default, colocated builder
+// daemon, clearing away any stale socket left behind by a previous
+// process.
+func ListenLocal(socketPath string) (net.Listener, error) {
+	if err := os.RemoveAll(socketPath); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", socketPath)
+}
+
+// archiveChunkSize is how much of the built archive BuildImage streams
+// back per BuildImageProgress message.
+const archiveChunkSize = 1 << 20 // 1 MiB
+
+// BuildImage implements nixbuilder.NixBuilderServer.
+//
+// It builds to a temp file of its own, never req.OutputArchivePath: that
+// path is meaningful only on the caller's filesystem, which this server
+// may not share (the whole point of a remote build farm). Once the build
+// finishes, it streams the archive back as a sequence of ArchiveChunk
+// messages and a final message carrying the real sha256 digest, so the
+// caller can write it to OutputArchivePath itself.
+//
+// Progress is only ever "starting build" and "build complete" bookending
+// s.builder's call: nix2container.Build (the only NixBuilder the default,
+// colocated daemon runs) shells out to `nix build` without exposing its
+// stderr as it's produced, so there's nothing incremental to relay there.
+func (s *BuilderServer) BuildImage(req *nixbuilder.BuildImageRequest, stream nixbuilder.NixBuilder_BuildImageServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	s.mu.Lock()
+	s.cancels[req.Id] = cancel
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.cancels, req.Id)
+		s.mu.Unlock()
+		cancel()
+	}()
+
+	archiveFile, err := os.CreateTemp("", "nix-builder-archive-*")
+	if err != nil {
+		return fmt.Errorf("failed to create build staging file: %w", err)
+	}
+	archivePath := archiveFile.Name()
+	archiveFile.Close()
+	defer os.Remove(archivePath)
+
+	if err := stream.Send(&nixbuilder.BuildImageProgress{Progress: "starting build"}); err != nil {
+		return err
+	}
+	if err := s.builder.BuildImage(ctx, req.Ref, req.System, archivePath, req.Credentials); err != nil {
+		return err
+	}
+
+	digest, err := fileDigest(archivePath)
+	if err != nil {
+		return fmt.Errorf("failed to digest %s: %w", archivePath, err)
+	}
+	if err := streamArchive(archivePath, stream); err != nil {
+		return fmt.Errorf("failed to stream build archive back: %w", err)
+	}
+	return stream.Send(&nixbuilder.BuildImageProgress{
+		Progress: "build complete",
+		Digest:   digest,
+	})
+}
+
+// streamArchive sends the file at archivePath to stream as a sequence of
+// ArchiveChunk messages.
+func streamArchive(archivePath string, stream nixbuilder.NixBuilder_BuildImageServer) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, archiveChunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if sendErr := stream.Send(&nixbuilder.BuildImageProgress{ArchiveChunk: chunk}); sendErr != nil {
+				return sendErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fileDigest returns the sha256 content digest of the file at path, in
+// "sha256:<hex>" form.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CancelBuild implements nixbuilder.NixBuilderServer.
+func (s *BuilderServer) CancelBuild(ctx context.Context, req *nixbuilder.CancelBuildRequest) (*nixbuilder.CancelBuildResponse, error) {
+	s.mu.Lock()
+	cancel, ok := s.cancels[req.Id]
+	s.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return &nixbuilder.CancelBuildResponse{}, nil
+}
@@ -0,0 +1,51 @@
+package nix
+
+import "crypto/tls"
+
+// Config holds configuration shared by the snapshotter and the image
+// service.
+type Config struct {
+	nixBuilder NixBuilder
+
+	builderAddr      string
+	builderTLSConfig *tls.Config
+}
+
+type nixBuilderOpt struct {
+	builder NixBuilder
+}
+
+func (o nixBuilderOpt) SetImageServiceOpt(cfg *ImageServiceConfig) {
+	cfg.nixBuilder = o.builder
+}
+
+// WithNixBuilder overrides the NixBuilder used to build nix: image
+// references that miss the local archive cache. It is mainly useful in
+// tests.
+func WithNixBuilder(builder NixBuilder) ImageServiceOpt {
+	return nixBuilderOpt{builder}
+}
+
+type builderAddrOpt struct {
+	addr      string
+	tlsConfig *tls.Config
+}
+
+func (o builderAddrOpt) SetImageServiceOpt(cfg *ImageServiceConfig) {
+	cfg.builderAddr = o.addr
+	cfg.builderTLSConfig = o.tlsConfig
+}
+
+// WithBuilderAddr configures the image service to offload nix builds to a
+// NixBuilder gRPC server at addr instead of building on the local host. A
+// nil tlsConfig dials addr as a local Unix socket; a non-nil tlsConfig
+// dials addr over TCP/mTLS, for a remote build farm.
+//
+// NOTE: no cmd-level flag calls this yet in this tree (there is no cmd
+// package here to wire one up in) — it's reachable as a library call
+// today, not from the built binary. Whatever wires up nix-snapshotter's
+// main command needs a --builder-addr (and --builder-tls-*) flag that
+// calls this before that's true.
+func WithBuilderAddr(addr string, tlsConfig *tls.Config) ImageServiceOpt {
+	return builderAddrOpt{addr, tlsConfig}
+}
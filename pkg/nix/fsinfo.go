@@ -0,0 +1,36 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// nixStoreDir is the nix store whose usage nixStoreFsUsage reports.
+const nixStoreDir = "/nix/store"
+
+// nixStoreFsUsage reports disk usage of the nix store, separately from
+// whatever filesystem backs containerd's own content store, so that
+// kubelet's image GC pressure signal reflects where nix-snapshotter
+// actually keeps its image data.
+func nixStoreFsUsage(ctx context.Context, timestamp int64) (*runtime.FilesystemUsage, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(nixStoreDir, &stat); err != nil {
+		return nil, fmt.Errorf("failed to statfs %s: %w", nixStoreDir, err)
+	}
+
+	blockSize := uint64(stat.Bsize)
+	usedBytes := (stat.Blocks - stat.Bfree) * blockSize
+	usedInodes := stat.Files - stat.Ffree
+
+	return &runtime.FilesystemUsage{
+		Timestamp: timestamp,
+		FsId: &runtime.FilesystemIdentifier{
+			Mountpoint: nixStoreDir,
+		},
+		UsedBytes:  &runtime.UInt64Value{Value: usedBytes},
+		InodesUsed: &runtime.UInt64Value{Value: usedInodes},
+	}, nil
+}
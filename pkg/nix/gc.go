@@ -0,0 +1,77 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// gcRootsDir is where nix-snapshotter places its own GC roots, one per
+// pulled image, so that a nix image archive (and everything it
+// references) stays live in the nix store until the image backing it is
+// removed.
+const gcRootsDir = "/nix/var/nix/gcroots/nix-snapshotter"
+
+// defaultGCSweepInterval is how often startGCSweep runs
+// nix-collect-garbage, to reclaim store paths for images that were
+// removed outside of RemoveImage, e.g. by pruning containerd's content
+// store directly.
+const defaultGCSweepInterval = 1 * time.Hour
+
+// addGCRoot symlinks archivePath into gcRootsDir under imageDigest, so
+// that removeGCRoot can later unpin exactly the store paths this image
+// pinned.
+func addGCRoot(imageDigest, archivePath string) error {
+	if err := os.MkdirAll(gcRootsDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create nix-snapshotter gcroots dir: %w", err)
+	}
+	root := gcRootPath(imageDigest)
+	if err := os.RemoveAll(root); err != nil {
+		return fmt.Errorf("failed to clear stale gcroot for %s: %w", imageDigest, err)
+	}
+	if err := os.Symlink(archivePath, root); err != nil {
+		return fmt.Errorf("failed to add gcroot for %s: %w", imageDigest, err)
+	}
+	return nil
+}
+
+// removeGCRoot undoes addGCRoot, making the nix store paths an image's
+// archive referenced eligible for garbage collection again. It is a
+// no-op, not an error, if imageDigest never had a gcroot (e.g. because it
+// wasn't a nix: image).
+func removeGCRoot(imageDigest string) error {
+	if err := os.RemoveAll(gcRootPath(imageDigest)); err != nil {
+		return fmt.Errorf("failed to remove gcroot for %s: %w", imageDigest, err)
+	}
+	return nil
+}
+
+func gcRootPath(imageDigest string) string {
+	return filepath.Join(gcRootsDir, imageDigest)
+}
+
+// startGCSweep runs nix-collect-garbage on interval until ctx is
+// cancelled.
+func startGCSweep(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				log.G(ctx).Debug("[image-service] Running nix-collect-garbage sweep")
+				cmd := exec.CommandContext(ctx, "nix-collect-garbage")
+				if out, err := cmd.CombinedOutput(); err != nil {
+					log.G(ctx).WithError(err).Warnf("[image-service] nix-collect-garbage sweep failed: %s", out)
+				}
+			}
+		}
+	}()
+}
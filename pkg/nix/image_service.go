@@ -3,6 +3,7 @@ package nix
 import (
 	"context"
 	"errors"
+	"fmt"
 	"os"
 	"regexp"
 	"strings"
@@ -12,11 +13,24 @@ import (
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	nixbuilder "github.com/pdtpartners/nix-snapshotter/api/services/nixbuilder/v1"
 	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/sys/unix"
 	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
 	goruntime "runtime"
 )
 
+// nixSystemToOCIPlatform maps a nix system double to the OCI platform it
+// corresponds to, so that imageService can pick a manifest out of an
+// index.json the same way containerd and podman do.
+var nixSystemToOCIPlatform = map[string]ocispec.Platform{
+	"x86-64-linux":  {OS: "linux", Architecture: "amd64"},
+	"aarch64-linux": {OS: "linux", Architecture: "arm64"},
+}
+
 var (
 	ErrNotInitialized = errors.New("Nix-snapshotter Image Service not yet initialized")
 )
@@ -37,6 +51,45 @@ type imageService struct {
 	imageServiceClient runtime.ImageServiceClient
 	nixBuilder         NixBuilder
 	nixSystem          string
+
+	// loadImage loads a nix image archive already on disk and returns its
+	// image ref. It defaults to defaultLoadImage, and is only a field so
+	// that tests can stub it out without a real containerd client.
+	loadImage loadImageFunc
+
+	// addGCRoot and removeGCRoot pin and unpin a pulled image's archive in
+	// the nix store. They default to addGCRoot and removeGCRoot (gc.go),
+	// and are only fields so that tests can stub them out instead of
+	// touching the real /nix/var/nix/gcroots on whatever host runs them.
+	addGCRoot    addGCRootFunc
+	removeGCRoot removeGCRootFunc
+
+	// sf collapses concurrent PullImage calls for the same archivePath
+	// into a single build+load, so that e.g. a Deployment rollout
+	// pulling the same nix: ref across many pods doesn't run
+	// is.nixBuilder and nix2container.Load once per pod.
+	sf singleflight.Group
+}
+
+// loadImageFunc loads a nix image archive already on disk, matching it
+// against a platform, and returns its image ref (the digest of its
+// config).
+type loadImageFunc func(ctx context.Context, client *containerd.Client, archivePath string, matcher platforms.MatchComparer) (string, error)
+
+// addGCRootFunc and removeGCRootFunc match gc.go's addGCRoot/removeGCRoot.
+type addGCRootFunc func(imageDigest, archivePath string) error
+type removeGCRootFunc func(imageDigest string) error
+
+func defaultLoadImage(ctx context.Context, client *containerd.Client, archivePath string, matcher platforms.MatchComparer) (string, error) {
+	img, err := nix2container.Load(ctx, client, archivePath, matcher)
+	if err != nil {
+		return "", err
+	}
+	configDesc, err := img.Config(ctx)
+	if err != nil {
+		return "", err
+	}
+	return configDesc.Digest.String(), nil
 }
 
 func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageServiceOpt) (runtime.ImageServiceServer, error) {
@@ -49,6 +102,14 @@ func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageSe
 		opt.SetImageServiceOpt(&cfg)
 	}
 
+	if cfg.builderAddr != "" {
+		builder, err := DialBuilder(ctx, cfg.builderAddr, cfg.builderTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		cfg.nixBuilder = builder
+	}
+
 	var system string
 	if goruntime.GOOS == "linux" && goruntime.GOARCH == "amd64" {
 		system = "x86-64-linux"
@@ -59,8 +120,11 @@ func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageSe
 	}
 
 	service := &imageService{
-		nixBuilder: cfg.nixBuilder,
-		nixSystem:  system,
+		nixBuilder:   cfg.nixBuilder,
+		nixSystem:    system,
+		loadImage:    defaultLoadImage,
+		addGCRoot:    addGCRoot,
+		removeGCRoot: removeGCRoot,
 	}
 
 	go func() {
@@ -81,6 +145,8 @@ func NewImageService(ctx context.Context, containerdAddr string, opts ...ImageSe
 		log.G(ctx).Warnf("No connection is available to CRI")
 	}()
 
+	startGCSweep(ctx, defaultGCSweepInterval)
+
 	return service, nil
 }
 
@@ -125,34 +191,147 @@ func (is *imageService) PullImage(ctx context.Context, req *runtime.PullImageReq
 		return resp, err
 	}
 	archivePath := getNixStorePath(ctx, ref, is.nixSystem)
+	creds := buildCredentials(req)
+
+	imageRefVal, err, _ := is.sf.Do(archivePath, func() (interface{}, error) {
+		return is.buildAndLoadImage(ctx, ref, archivePath, creds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	imageRef := imageRefVal.(string)
+
+	log.G(ctx).WithField("imageRef", imageRef).Info("[image-service] Successfully pulled image")
+	return &runtime.PullImageResponse{
+		ImageRef: imageRef,
+	}, nil
+}
 
-	_, err := os.Stat(archivePath)
-	if errors.Is(err, os.ErrNotExist) {
+// flakeAccessTokensAnnotation is a pod spec image annotation carrying
+// bearer tokens for private flake hosts (e.g. a private GitHub flake
+// input), as opposed to the registry serving the image itself. Its value
+// is a space-separated list of "host=token" pairs, the same shape nix
+// itself expects for a NIX_CONFIG access-tokens line, because the flake
+// host (e.g. github.com) is generally not the registry host (e.g.
+// gcr.io) carried by PullImageRequest.Auth and so can't be derived from
+// it.
+const flakeAccessTokensAnnotation = "nix-snapshotter.io/flake-access-tokens"
+
+// buildCredentials maps a CRI PullImageRequest's auth config and image
+// annotations into the structured credentials NixBuilder forwards to the
+// child `nix build` process, so that private registries and private
+// flake hosts resolve the same way for a nix: pull as they would for
+// kubelet's own CRI pull.
+//
+// imagePullSecrets referenced by a pod spec are not folded in here: the
+// image service has no Kubernetes client to look them up with, only what
+// the CRI PullImageRequest itself carries (registry auth, plus the
+// flake-access-tokens annotation above). A pull relying solely on an
+// imagePullSecret for a private registry or flake host does not
+// authenticate.
+func buildCredentials(req *runtime.PullImageRequest) *nixbuilder.BuildCredentials {
+	var creds nixbuilder.BuildCredentials
+
+	if auth := req.Auth; auth != nil && (auth.Username != "" || auth.Password != "" || auth.IdentityToken != "") {
+		host := auth.ServerAddress
+		if host == "" {
+			host = "*"
+		}
+		creds.Registries = map[string]*nixbuilder.RegistryAuth{
+			host: {
+				Username:      auth.Username,
+				Password:      auth.Password,
+				IdentityToken: auth.IdentityToken,
+			},
+		}
+	}
+
+	if spec := req.Image; spec != nil {
+		if tokens := spec.Annotations[flakeAccessTokensAnnotation]; tokens != "" {
+			creds.FlakeHostTokens = make(map[string]string)
+			for _, pair := range strings.Fields(tokens) {
+				host, token, ok := strings.Cut(pair, "=")
+				if !ok || host == "" || token == "" {
+					continue
+				}
+				creds.FlakeHostTokens[host] = token
+			}
+			if len(creds.FlakeHostTokens) == 0 {
+				creds.FlakeHostTokens = nil
+			}
+		}
+	}
+
+	if creds.Registries == nil && creds.FlakeHostTokens == nil {
+		return nil
+	}
+	return &creds
+}
+
+// buildAndLoadImage builds ref into archivePath if it isn't already on
+// disk, then loads it. It takes an flock on archivePath to coordinate with
+// other nix-snapshotter processes (or a snapshotter restart mid-build)
+// doing the same; is.sf additionally collapses concurrent callers within
+// this process into one call and hands them all its result, where the
+// flock alone would only make them wait and then each load the archive
+// again in turn.
+func (is *imageService) buildAndLoadImage(ctx context.Context, ref, archivePath string, creds *nixbuilder.BuildCredentials) (string, error) {
+	unlock, err := lockArchivePath(archivePath)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(archivePath); errors.Is(err, os.ErrNotExist) {
 		log.G(ctx).Info("[image-service] Pulling nix image archive")
-		err := is.nixBuilder(ctx, "", archivePath)
+		// Build to a temp path under the same directory and rename into
+		// place only on success, so a build that fails or is interrupted
+		// partway through (e.g. by a snapshotter restart) never leaves a
+		// partial file at archivePath for the next caller's os.Stat check
+		// to mistake for a complete one.
+		tmpPath := archivePath + ".tmp"
+		err := is.nixBuilder.BuildImage(ctx, ref, is.nixSystem, tmpPath, creds)
 		if err != nil {
-			return nil, err
+			os.Remove(tmpPath)
+			return "", err
+		}
+		if err := os.Rename(tmpPath, archivePath); err != nil {
+			os.Remove(tmpPath)
+			return "", fmt.Errorf("failed to finalize nix image archive for %s: %w", ref, err)
 		}
 	} else if err != nil {
-		return nil, err
+		return "", err
 	}
 
 	log.G(ctx).Info("[image-service] Loading nix image archive")
-	ctx = namespaces.WithNamespace(ctx, "k8s.io")
-	img, err := nix2container.Load(ctx, is.client, archivePath)
+	loadCtx := namespaces.WithNamespace(ctx, "k8s.io")
+	matcher := platforms.Only(nixSystemToOCIPlatform[is.nixSystem])
+	imageRef, err := is.loadImage(loadCtx, is.client, archivePath, matcher)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	configDesc, err := img.Config(ctx)
-	if err != nil {
-		return nil, err
+	if err := is.addGCRoot(imageRef, archivePath); err != nil {
+		return "", fmt.Errorf("failed to pin %s in the nix store: %w", archivePath, err)
 	}
-	imageRef := configDesc.Digest.String()
 
-	log.G(ctx).WithField("imageRef", imageRef).Info("[image-service] Successfully pulled image")
-	return &runtime.PullImageResponse{
-		ImageRef: imageRef,
+	return imageRef, nil
+}
+
+// lockArchivePath takes an exclusive flock on archivePath+".lock", and
+// returns a func that releases it.
+func lockArchivePath(archivePath string) (func(), error) {
+	f, err := os.OpenFile(archivePath+".lock", os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file for %s: %w", archivePath, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", archivePath, err)
+	}
+	return func() {
+		unix.Flock(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
 	}, nil
 }
 
@@ -164,7 +343,17 @@ func (is *imageService) RemoveImage(ctx context.Context, req *runtime.RemoveImag
 	if client == nil {
 		return nil, ErrNotInitialized
 	}
-	return client.RemoveImage(ctx, req)
+	resp, err := client.RemoveImage(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// This is a no-op for images that were never a nix: pull, so it's
+	// safe to call unconditionally.
+	if err := is.removeGCRoot(req.Image.Image); err != nil {
+		log.G(ctx).WithError(err).Warnf("[image-service] Failed to remove nix gcroot for %s", req.Image.Image)
+	}
+	return resp, nil
 }
 
 // ImageFSInfo returns information of the filesystem that is used to store images.
@@ -173,16 +362,57 @@ func (is *imageService) ImageFsInfo(ctx context.Context, req *runtime.ImageFsInf
 	if client == nil {
 		return nil, ErrNotInitialized
 	}
-	return client.ImageFsInfo(ctx, req)
+	resp, err := client.ImageFsInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	nixUsage, err := nixStoreFsUsage(ctx, time.Now().UnixNano())
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("[image-service] Failed to collect nix store filesystem usage")
+		return resp, nil
+	}
+	resp.ImageFilesystems = append(resp.ImageFilesystems, nixUsage)
+	return resp, nil
 }
 
-// getNixStorePath extracts the store path from the image ref.
+// getNixStorePath extracts the store path of the archive to load for ref
+// and system.
+//
+// New multi-platform image refs (/index/<path-to-index.json>) point at a
+// real OCI image index: an index.json listing one manifest per platform,
+// each annotated with the nix store archive path nix2container built it
+// into (see archivePathAnnotation). getNixStorePath resolves these by
+// reading that index and picking the manifest matching system with a
+// platforms.Matcher, via readOCIIndex/resolveIndexArchivePath, the same
+// way containerd resolves a real registry's image index. nix2container
+// (the index's only intended producer) is outside this tree, though, so
+// nothing here emits an /index/ ref yet: every real pull still resolves
+// through the /multiarch/ handling below, a compatibility shim for refs
+// that instead concatenate a <system>/nix/store/<hash> segment per
+// platform into a single ref; it is parsed, not replaced, so archives
+// pulled under that scheme keep resolving correctly.
 func getNixStorePath(ctx context.Context, ref string, system string) string {
 	path := strings.TrimSuffix(
 		strings.TrimPrefix(ref, nix2container.ImageRefPrefix),
 		":latest",
 	)
 
+	if strings.HasPrefix(path, "/index/") {
+		indexPath, _ := strings.CutPrefix(path, "/index/")
+		index, err := readOCIIndex(indexPath)
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("Failed to read image index for %s", ref)
+			return path
+		}
+		archivePath, err := resolveIndexArchivePath(index, platforms.Only(nixSystemToOCIPlatform[system]))
+		if err != nil {
+			log.G(ctx).WithError(err).Errorf("Failed to resolve image index for %s", ref)
+			return path
+		}
+		return archivePath
+	}
+
 	if strings.HasPrefix(path, "/multiarch/") {
 		path, _ = strings.CutPrefix(path, "/multiarch/")
 
@@ -2,7 +2,18 @@ package nix
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	nixbuilder "github.com/pdtpartners/nix-snapshotter/api/services/nixbuilder/v1"
+	"github.com/pdtpartners/nix-snapshotter/pkg/nix2container"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 func TestGetNixStorePath(t *testing.T) {
@@ -31,3 +42,122 @@ func TestGetNixStorePath(t *testing.T) {
 		t.Fatalf("Expected %s, received %s", expected, received)
 	}
 }
+
+// TestGetNixStorePathIndex asserts that an /index/ ref is resolved by
+// reading an OCI image index off disk and picking the manifest matching
+// the requested system, rather than by parsing the ref itself.
+func TestGetNixStorePathIndex(t *testing.T) {
+	ctx := context.Background()
+
+	indexPath := filepath.Join(t.TempDir(), "index.json")
+	index := ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{
+				Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"},
+				Annotations: map[string]string{
+					archivePathAnnotation: "/nix/store/zkw3cjabs8lc8bv4sgnm6x132gm956fc-nix-image-nginx.tar",
+				},
+			},
+			{
+				Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"},
+				Annotations: map[string]string{
+					archivePathAnnotation: "/nix/store/dbc4mhv2fjbfx8pypx88qgp8nfp392az-nix-image-nginx.tar",
+				},
+			},
+		},
+	}
+	data, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Failed to marshal test index: %v", err)
+	}
+	if err := os.WriteFile(indexPath, data, 0o644); err != nil {
+		t.Fatalf("Failed to write test index: %v", err)
+	}
+
+	ref := nix2container.ImageRefPrefix + "/index/" + indexPath + ":latest"
+
+	expected := "/nix/store/dbc4mhv2fjbfx8pypx88qgp8nfp392az-nix-image-nginx.tar"
+	received := getNixStorePath(ctx, ref, "x86-64-linux")
+	if received != expected {
+		t.Fatalf("Expected %s, received %s", expected, received)
+	}
+
+	expected = "/nix/store/zkw3cjabs8lc8bv4sgnm6x132gm956fc-nix-image-nginx.tar"
+	received = getNixStorePath(ctx, ref, "aarch64-linux")
+	if received != expected {
+		t.Fatalf("Expected %s, received %s", expected, received)
+	}
+}
+
+// countingBuilder is a NixBuilder that records how many times BuildImage
+// was invoked, and writes a placeholder archive so later os.Stat checks
+// see it as already built.
+type countingBuilder struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (b *countingBuilder) BuildImage(ctx context.Context, ref, system, archivePath string, creds *nixbuilder.BuildCredentials) error {
+	b.mu.Lock()
+	b.calls++
+	b.mu.Unlock()
+	return os.WriteFile(archivePath, []byte("fake nix image archive"), 0o644)
+}
+
+// fakeCRIClient satisfies runtime.ImageServiceClient without implementing
+// any of its methods, since PullImage never calls through to it for nix:
+// refs.
+type fakeCRIClient struct {
+	runtime.ImageServiceClient
+}
+
+// TestPullImageSingleflight asserts that concurrent PullImage calls for
+// the same nix: ref collapse into a single is.nixBuilder invocation.
+func TestPullImageSingleflight(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "nix-image-test.tar")
+	ref := nix2container.ImageRefPrefix + archivePath + ":latest"
+
+	builder := &countingBuilder{}
+	is := &imageService{
+		imageServiceClient: fakeCRIClient{},
+		nixBuilder:         builder,
+		nixSystem:          "x86-64-linux",
+		loadImage: func(ctx context.Context, client *containerd.Client, archivePath string, matcher platforms.MatchComparer) (string, error) {
+			return "sha256:deadbeef", nil
+		},
+		// Stubbed out so this test never touches the real
+		// /nix/var/nix/gcroots on whatever host runs it.
+		addGCRoot:    func(imageDigest, archivePath string) error { return nil },
+		removeGCRoot: func(imageDigest string) error { return nil },
+	}
+
+	const n = 10
+	responses := make([]*runtime.PullImageResponse, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			responses[i], errs[i] = is.PullImage(context.Background(), &runtime.PullImageRequest{
+				Image: &runtime.ImageSpec{Image: ref},
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("PullImage %d returned error: %v", i, err)
+		}
+		if responses[i].ImageRef != "sha256:deadbeef" {
+			t.Fatalf("PullImage %d returned ImageRef %q, want sha256:deadbeef", i, responses[i].ImageRef)
+		}
+	}
+
+	if builder.calls != 1 {
+		t.Fatalf("expected nixBuilder to be invoked once, got %d", builder.calls)
+	}
+}
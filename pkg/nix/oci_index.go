@@ -0,0 +1,57 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// archivePathAnnotation is the manifest annotation an OCI image index
+// produced for a nix: multi-platform ref carries on each of its entries,
+// recording the nix store archive that platform's manifest was built
+// into. Plain OCI indexes point their manifests at content-addressed
+// blobs, but nix2container builds a standalone tar archive per platform
+// on the local nix store instead, so the index needs a way to say where
+// that archive lives.
+//
+// NOTE: nix2container (this index's only intended producer) lives
+// outside this tree, so nothing here actually emits an /index/ ref;
+// every real PullImage still resolves through the /multiarch/ shim in
+// getNixStorePath (image_service.go). readOCIIndex/resolveIndexArchivePath
+// exist so that consuming such a ref already works once something
+// produces one.
+const archivePathAnnotation = "io.pdtpartners.nix-snapshotter.archive-path"
+
+// readOCIIndex reads and parses the OCI image index at indexPath.
+func readOCIIndex(indexPath string) (*ocispec.Index, error) {
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image index %s: %w", indexPath, err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse image index %s: %w", indexPath, err)
+	}
+	return &index, nil
+}
+
+// resolveIndexArchivePath picks the manifest in index matching matcher,
+// the same way containerd and podman pick a manifest out of a real
+// registry's image index, and returns the nix store archive path its
+// archivePathAnnotation records.
+func resolveIndexArchivePath(index *ocispec.Index, matcher platforms.Matcher) (string, error) {
+	for _, manifest := range index.Manifests {
+		if manifest.Platform == nil || !matcher.Match(*manifest.Platform) {
+			continue
+		}
+		archivePath, ok := manifest.Annotations[archivePathAnnotation]
+		if !ok {
+			return "", fmt.Errorf("manifest for %s has no %s annotation", platforms.Format(*manifest.Platform), archivePathAnnotation)
+		}
+		return archivePath, nil
+	}
+	return "", fmt.Errorf("image index has no manifest matching %s", matcher)
+}